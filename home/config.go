@@ -86,8 +86,11 @@ type dnsConfig struct {
 
 	dnsforward.FilteringConfig `yaml:",inline"`
 
-	FilteringEnabled           bool             `yaml:"filtering_enabled"`       // whether or not use filter lists
-	FiltersUpdateIntervalHours uint32           `yaml:"filters_update_interval"` // time period to update filters (in hours)
+	FilteringEnabled           bool             `yaml:"filtering_enabled"`            // whether or not use filter lists
+	FiltersUpdateIntervalHours uint32           `yaml:"filters_update_interval"`      // time period to update filters (in hours)
+	FiltersUpdateInitialDelay  uint32           `yaml:"filters_update_initial_delay"` // delay before the first check for filters updates (in seconds)
+	FiltersUpdateMaxDelay      uint32           `yaml:"filters_update_max_delay"`     // maximum delay between checks for filters updates (in seconds)
+	FiltersRejectDuplicates    bool             `yaml:"filters_reject_duplicates"`    // refuse to add a filter with the same contents as an existing enabled filter
 	DnsfilterConf              dnsfilter.Config `yaml:",inline"`
 }
 
@@ -122,6 +125,8 @@ var config = configuration{
 		},
 		FilteringEnabled:           true, // whether or not use filter lists
 		FiltersUpdateIntervalHours: 24,
+		FiltersUpdateInitialDelay:  defaultFiltersUpdateInitialDelay,
+		FiltersUpdateMaxDelay:      defaultFiltersUpdateMaxDelay,
 	},
 	TLS: tlsConfigSettings{
 		PortHTTPS:      443,
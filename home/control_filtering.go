@@ -38,6 +38,7 @@ type filterAddJSON struct {
 	Name      string `json:"name"`
 	URL       string `json:"url"`
 	Whitelist bool   `json:"whitelist"`
+	Trusted   bool   `json:"trusted"`
 }
 
 func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
@@ -64,6 +65,7 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 		Enabled: true,
 		URL:     fj.URL,
 		Name:    fj.Name,
+		Trusted: fj.Trusted,
 		white:   fj.Whitelist,
 	}
 	filt.ID = assignUniqueFilterID()
@@ -71,6 +73,10 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 	// Download the filter contents
 	ok, err := f.update(&filt)
 	if err != nil {
+		if isStorageError(err) {
+			httpError(w, http.StatusInternalServerError, "Couldn't save filter from url %s: %s", filt.URL, err)
+			return
+		}
 		httpError(w, http.StatusBadRequest, "Couldn't fetch filter from url %s: %s", filt.URL, err)
 		return
 	}
@@ -79,6 +85,18 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	duplicate := ""
+	if same, ok := filterWithSameData(filt.checksum); ok {
+		duplicate = fmt.Sprintf("the filter has the same contents as filter #%d (%s) at %s",
+			same.ID, same.Name, same.URL)
+		if config.DNS.FiltersRejectDuplicates {
+			_ = os.Remove(filt.Path())
+			httpError(w, http.StatusBadRequest, "Filter %s is not added: %s", filt.URL, duplicate)
+			return
+		}
+		log.Error("Filter %s: %s", filt.URL, duplicate)
+	}
+
 	// URL is deemed valid, append it to filters, update config, write new filter file and tell dns to reload it
 	if !filterAdd(filt) {
 		httpError(w, http.StatusBadRequest, "Filter URL already added -- %s", filt.URL)
@@ -88,7 +106,11 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 	onConfigModified()
 	enableFilters(true)
 
-	_, err = fmt.Fprintf(w, "OK %d rules\n", filt.RulesCount)
+	msg := fmt.Sprintf("OK %d rules\n", filt.RulesCount)
+	if len(duplicate) != 0 {
+		msg += fmt.Sprintf("Warning: %s\n", duplicate)
+	}
+	_, err = fmt.Fprint(w, msg)
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "Couldn't write body: %s", err)
 	}
@@ -139,6 +161,7 @@ type filterURLJSON struct {
 	Name    string `json:"name"`
 	URL     string `json:"url"`
 	Enabled bool   `json:"enabled"`
+	Trusted bool   `json:"trusted"`
 }
 
 type filterURLReq struct {
@@ -164,6 +187,7 @@ func (f *Filtering) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 		Enabled: fj.Data.Enabled,
 		Name:    fj.Data.Name,
 		URL:     fj.Data.URL,
+		Trusted: fj.Data.Trusted,
 	}
 	status := f.filterSetProperties(fj.URL, filt, fj.Whitelist)
 	if (status & statusFound) == 0 {
@@ -251,12 +275,18 @@ func (f *Filtering) handleFilteringRefresh(w http.ResponseWriter, r *http.Reques
 }
 
 type filterJSON struct {
-	ID          int64  `json:"id"`
-	Enabled     bool   `json:"enabled"`
-	URL         string `json:"url"`
-	Name        string `json:"name"`
-	RulesCount  uint32 `json:"rules_count"`
-	LastUpdated string `json:"last_updated"`
+	ID              int64  `json:"id"`
+	Enabled         bool   `json:"enabled"`
+	URL             string `json:"url"`
+	Name            string `json:"name"`
+	Trusted         bool   `json:"trusted"`
+	RulesCount      uint32 `json:"rules_count"`
+	AllowRulesCount uint32 `json:"allow_rules_count"`
+	CommentsCount   uint32 `json:"comments_count"`
+	LinesCount      uint32 `json:"lines_count"`
+	SyntaxHeader    string `json:"syntax_header"`
+	LastUpdated     string `json:"last_updated"`
+	LastChanged     string `json:"last_changed"`
 }
 
 type filteringConfig struct {
@@ -269,16 +299,24 @@ type filteringConfig struct {
 
 func filterToJSON(f filter) filterJSON {
 	fj := filterJSON{
-		ID:         f.ID,
-		Enabled:    f.Enabled,
-		URL:        f.URL,
-		Name:       f.Name,
-		RulesCount: uint32(f.RulesCount),
+		ID:              f.ID,
+		Enabled:         f.Enabled,
+		URL:             f.URL,
+		Name:            f.Name,
+		Trusted:         f.Trusted,
+		RulesCount:      uint32(f.RulesCount),
+		AllowRulesCount: uint32(f.AllowRulesCount),
+		CommentsCount:   uint32(f.CommentsCount),
+		LinesCount:      uint32(f.LinesCount),
+		SyntaxHeader:    f.SyntaxHeader,
 	}
 
 	if !f.LastUpdated.IsZero() {
 		fj.LastUpdated = f.LastUpdated.Format(time.RFC3339)
 	}
+	if !f.LastChanged.IsZero() {
+		fj.LastChanged = f.LastChanged.Format(time.RFC3339)
+	}
 
 	return fj
 }
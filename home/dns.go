@@ -80,7 +80,11 @@ func initDNSServer() error {
 	Context.rdns = InitRDNS(Context.dnsServer, &Context.clients)
 	Context.whois = initWhois(&Context.clients)
 
-	Context.filters.Init()
+	err = Context.filters.Init()
+	if err != nil {
+		closeDNSServer()
+		return fmt.Errorf("filters.Init: %s", err)
+	}
 	return nil
 }
 
@@ -2,6 +2,9 @@ package home
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -13,6 +16,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/dnsfilter"
@@ -33,14 +37,20 @@ type Filtering struct {
 }
 
 // Init - initialize the module
-func (f *Filtering) Init() {
+func (f *Filtering) Init() error {
 	f.filterTitleRegexp = regexp.MustCompile(`^! Title: +(.*)$`)
-	_ = os.MkdirAll(filepath.Join(Context.getDataDir(), filterDir), 0755)
+	dir := filepath.Join(Context.getDataDir(), filterDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("couldn't create filters directory %s: %w", dir, err)
+	}
+	// Existing IDs must be known before loadFilters() assigns new ones
+	updateUniqueFilterID(config.Filters)
+	updateUniqueFilterID(config.WhitelistFilters)
 	f.loadFilters(config.Filters)
 	f.loadFilters(config.WhitelistFilters)
 	deduplicateFilters()
-	updateUniqueFilterID(config.Filters)
-	updateUniqueFilterID(config.WhitelistFilters)
+	return nil
 }
 
 // Start - start the module
@@ -67,13 +77,19 @@ func defaultFilters() []filter {
 
 // field ordering is important -- yaml fields will mirror ordering from here
 type filter struct {
-	Enabled     bool
-	URL         string    // URL or a file path
-	Name        string    `yaml:"name"`
-	RulesCount  int       `yaml:"-"`
-	LastUpdated time.Time `yaml:"-"`
-	checksum    uint32    // checksum of the file data
-	white       bool
+	Enabled         bool
+	URL             string    // URL or a file path
+	Name            string    `yaml:"name"`
+	Trusted         bool      `yaml:"trusted"` // don't check whether the data is an HTML page
+	RulesCount      int       `yaml:"-"` // number of rules, including allowlist rules
+	AllowRulesCount int       `yaml:"-"` // number of allowlist (@@) rules
+	CommentsCount   int       `yaml:"-"` // number of comment lines (starting with '!' or '#')
+	LinesCount      int       `yaml:"-"` // number of all lines, including empty lines and comments
+	SyntaxHeader    string    `yaml:"-"` // the first header line, e.g. "[Adblock Plus 2.0]"
+	LastUpdated     time.Time `yaml:"-"` // the last successful check for updates, even if the data hasn't changed
+	LastChanged     time.Time `yaml:"-"` // the last time the data has changed (unknown after restart)
+	checksum        uint32    // checksum of the file data
+	white           bool
 
 	dnsfilter.Filter `yaml:",inline"`
 }
@@ -114,9 +130,10 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 			continue
 		}
 
-		log.Debug("filter: set properties: %s: {%s %s %v}",
-			filt.URL, newf.Name, newf.URL, newf.Enabled)
+		log.Debug("filter: set properties: %s: {%s %s %v %v}",
+			filt.URL, newf.Name, newf.URL, newf.Enabled, newf.Trusted)
 		filt.Name = newf.Name
+		filt.Trusted = newf.Trusted
 
 		if filt.URL != newf.URL {
 			r |= statusURLChanged | statusUpdateRequired
@@ -126,6 +143,7 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 			filt.URL = newf.URL
 			filt.unload()
 			filt.LastUpdated = time.Time{}
+			filt.LastChanged = time.Time{}
 			filt.checksum = 0
 			filt.RulesCount = 0
 		}
@@ -140,8 +158,8 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 						// This isn't a fatal error,
 						//  because it may occur when someone removes the file from disk.
 						filt.LastUpdated = time.Time{}
-						filt.checksum = 0
-						filt.RulesCount = 0
+						filt.LastChanged = time.Time{}
+						filt.unload()
 						r |= statusUpdateRequired
 					}
 				}
@@ -177,6 +195,22 @@ func filterExistsNoLock(url string) bool {
 	return false
 }
 
+// Return an enabled filter with the same data checksum
+// The filters downloaded from different mirrors of the same list have equal checksums
+func filterWithSameData(checksum uint32) (filter, bool) {
+	config.RLock()
+	defer config.RUnlock()
+
+	for _, filters := range [][]filter{config.Filters, config.WhitelistFilters} {
+		for _, f := range filters {
+			if f.Enabled && f.checksum == checksum {
+				return f, true
+			}
+		}
+	}
+	return filter{}, false
+}
+
 // Add a filter
 // Return FALSE if a filter with this URL exists
 func filterAdd(f filter) bool {
@@ -234,26 +268,80 @@ func deduplicateFilters() {
 	config.Filters = config.Filters[:i]
 }
 
+// Return TRUE if the error means that filter data can't be saved
+//  because the disk is full or the filters directory isn't writable
+func isStorageError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) ||
+		errors.Is(err, syscall.EROFS) ||
+		errors.Is(err, os.ErrPermission)
+}
+
 // Set the next filter ID to max(filter.ID) + 1
 func updateUniqueFilterID(filters []filter) {
 	for _, filter := range filters {
-		if nextFilterID < filter.ID {
+		if nextFilterID <= filter.ID {
 			nextFilterID = filter.ID + 1
 		}
 	}
 }
 
+// Get a new filter ID.
+// IDs which already have a file on disk are skipped:
+// the file may belong to another filter if the system clock went backwards.
 func assignUniqueFilterID() int64 {
-	value := nextFilterID
-	nextFilterID++
-	return value
+	for {
+		f := filter{}
+		f.ID = nextFilterID
+		nextFilterID++
+
+		_, err := os.Stat(f.Path())
+		if err == nil {
+			log.Debug("filter: file for ID %d already exists, skipping this ID", f.ID)
+			continue
+		}
+		if !os.IsNotExist(err) {
+			// We can't tell whether the file exists.  Writing the file will fail with the same error anyway.
+			log.Debug("filter: checking file for ID %d: %s", f.ID, err)
+		}
+		return f.ID
+	}
+}
+
+const (
+	defaultFiltersUpdateInitialDelay = 5       // seconds
+	defaultFiltersUpdateMaxDelay     = 60 * 60 // seconds
+)
+
+// Get the initial and the maximum delay (in seconds) between checks for filters updates
+// On network errors the delay is doubled until it reaches the maximum
+func filtersUpdateDelays() (int, int) {
+	initial := int(config.DNS.FiltersUpdateInitialDelay)
+	if initial == 0 {
+		initial = defaultFiltersUpdateInitialDelay
+	}
+	maxDelay := int(config.DNS.FiltersUpdateMaxDelay)
+	if maxDelay == 0 {
+		maxDelay = defaultFiltersUpdateMaxDelay
+	}
+
+	if initial > maxDelay {
+		log.Info("Filters update initial delay %ds is greater than the maximum delay %ds, using %ds",
+			initial, maxDelay, maxDelay)
+		initial = maxDelay
+	}
+	return initial, maxDelay
 }
 
+// Sleep function used by periodicallyRefreshFilters (replaced in tests)
+var filtersUpdateSleep = time.Sleep
+
 // Sets up a timer that will be checking for filters updates periodically
+// The first check is performed after the initial delay
 func (f *Filtering) periodicallyRefreshFilters() {
-	const maxInterval = 1 * 60 * 60
-	intval := 5 // use a dynamically increasing time interval
+	intval, maxInterval := filtersUpdateDelays() // use a dynamically increasing time interval
 	for {
+		filtersUpdateSleep(time.Duration(intval) * time.Second)
+
 		isNetworkErr := false
 		if config.DNS.FiltersUpdateIntervalHours != 0 && atomic.CompareAndSwapUint32(&f.refreshStatus, 0, 1) {
 			f.refreshLock.Lock()
@@ -271,8 +359,6 @@ func (f *Filtering) periodicallyRefreshFilters() {
 				intval = maxInterval
 			}
 		}
-
-		time.Sleep(time.Duration(intval) * time.Second)
 	}
 }
 
@@ -315,6 +401,7 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 		uf.ID = f.ID
 		uf.URL = f.URL
 		uf.Name = f.Name
+		uf.Trusted = f.Trusted
 		uf.checksum = f.checksum
 		updateFilters = append(updateFilters, uf)
 	}
@@ -351,6 +438,10 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 			if f.ID != uf.ID || f.URL != uf.URL {
 				continue
 			}
+			if uf.LastUpdated.IsZero() {
+				// the update has failed
+				continue
+			}
 			f.LastUpdated = uf.LastUpdated
 			if !updated {
 				continue
@@ -359,8 +450,8 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 			log.Info("Updated filter #%d.  Rules: %d -> %d",
 				f.ID, f.RulesCount, uf.RulesCount)
 			f.Name = uf.Name
-			f.RulesCount = uf.RulesCount
-			f.checksum = uf.checksum
+			f.setContentsInfo(uf.contentsInfo())
+			f.LastChanged = uf.LastChanged
 			updateCount++
 		}
 		config.Unlock()
@@ -451,55 +542,190 @@ func isPrintableText(data []byte, len int) bool {
 	return true
 }
 
-// A helper function that parses filter contents and returns a number of rules and a filter name (if there's any)
-func (f *Filtering) parseFilterContents(file io.Reader) (int, uint32, string) {
-	rulesCount := 0
-	name := ""
+// Markers of anti-bot challenge pages (e.g. Cloudflare "Just a moment...")
+// Some of them may appear in cosmetic rules (e.g. "##.cf-browser-verification"),
+// so they are checked only if the data starts with a tag.
+var challengePageMarkers = []string{
+	"<title>just a moment...</title>",
+	"<title>attention required! | cloudflare</title>",
+	"cf-browser-verification",
+	"window._cf_chl_opt",
+}
+
+// Return TRUE if the data looks like an HTML (or XML) page rather than a filter list
+func isHTML(data []byte) bool {
+	s := strings.ToLower(string(data))
+	if strings.Contains(s, "<html") || strings.Contains(s, "<!doctype") {
+		return true
+	}
+
+	// Filter lists never start with a tag, so check the markup only if the data starts with one.
+	// This way we don't reject lists that mention these tags in their comments or rules.
+	s = strings.TrimLeft(strings.TrimPrefix(s, "\ufeff"), " \t\r\n")
+	if !strings.HasPrefix(s, "<") {
+		return false
+	}
+	for _, prefix := range []string{"<?xml", "<head", "<body", "<meta", "<title", "<script"} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	for _, marker := range challengePageMarkers {
+		if strings.Contains(s, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Maximum size of data decompressed from a gzip stream sent without Content-Encoding header
+const maxUnmarkedGzipSize = 256 * 1024 * 1024
+
+// Some mirrors send gzip-compressed data without setting Content-Encoding header.
+// http.Transport doesn't decode such data and it fails the printable text check.
+// If the data starts with gzip magic bytes, return a reader that decompresses it and TRUE.
+// The reader returns an error if decompressed data is larger than maxSize bytes.
+func decodeUnmarkedGzip(r io.Reader, maxSize int64) (io.Reader, bool, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if len(magic) != 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return br, false, nil
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, false, fmt.Errorf("data looks like gzip, but can't be decompressed: %w", err)
+	}
+	return &sizeLimitReader{r: zr, max: maxSize, left: maxSize}, true, nil
+}
+
+// A reader that returns an error instead of reading more than the specified number of bytes
+type sizeLimitReader struct {
+	r    io.Reader
+	max  int64
+	left int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// The limit is reached: it's OK only if there's no more data
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n == 0 && err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, fmt.Errorf("decompressed data is larger than %d bytes", l.max)
+	}
+
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
+// Return TRUE if the line is a syntax header, e.g. "[Adblock Plus 2.0]"
+// Rules with modifiers, e.g. "[$path=/page]example.org##.ad", aren't headers.
+func isSyntaxHeader(line []byte) bool {
+	return len(line) > 2 && line[0] == '[' && line[len(line)-1] == ']' && line[1] != '$'
+}
+
+// Information about the filter data
+type filterContentsInfo struct {
+	rulesCount      int    // number of rules, including allowlist rules
+	allowRulesCount int    // number of allowlist (@@) rules
+	commentsCount   int    // number of comment lines
+	linesCount      int    // number of all lines
+	syntaxHeader    string // the first header line
+	checksum        uint32 // checksum of the data
+	name            string // filter name (if there's any)
+}
+
+// A helper function that parses filter contents and returns the number of rules and a filter name
+// Returns an error if the data couldn't be read completely
+func (f *Filtering) parseFilterContents(file io.Reader) (filterContentsInfo, error) {
+	info := filterContentsInfo{}
 	seenTitle := false
 	r := bufio.NewReader(file)
-	checksum := uint32(0)
+	var long []byte // a line that doesn't fit into the reader's buffer
 
 	for {
-		line, err := r.ReadString('\n')
-		checksum = crc32.Update(checksum, crc32.IEEETable, []byte(line))
+		// ReadSlice doesn't allocate memory for every line, unlike ReadString
+		data, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			long = append(long, data...)
+			continue
+		}
+		if len(long) != 0 {
+			long = append(long, data...)
+			data = long
+		}
+		info.checksum = crc32.Update(info.checksum, crc32.IEEETable, data)
+		if len(data) != 0 {
+			info.linesCount++
+		}
 
-		line = strings.TrimSpace(line)
+		line := bytes.TrimSpace(data)
 		if len(line) == 0 {
 			//
 
 		} else if line[0] == '!' {
-			m := f.filterTitleRegexp.FindAllStringSubmatch(line, -1)
-			if len(m) > 0 && len(m[0]) >= 2 && !seenTitle {
-				name = m[0][1]
-				seenTitle = true
+			info.commentsCount++
+			if !seenTitle {
+				m := f.filterTitleRegexp.FindSubmatch(line)
+				if len(m) >= 2 {
+					info.name = string(m[1])
+					seenTitle = true
+				}
 			}
 
 		} else if line[0] == '#' {
-			//
+			info.commentsCount++
+
+		} else if isSyntaxHeader(line) {
+			if len(info.syntaxHeader) == 0 {
+				info.syntaxHeader = string(line)
+			}
 
 		} else {
-			rulesCount++
+			info.rulesCount++
+			if bytes.HasPrefix(line, []byte("@@")) {
+				info.allowRulesCount++
+			}
 		}
+		long = long[:0]
 
-		if err != nil {
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return filterContentsInfo{}, err
+		}
 	}
 
-	return rulesCount, checksum, name
+	return info, nil
 }
 
-// Perform upgrade on a filter and update LastUpdated value
+// Perform upgrade on a filter and update LastUpdated and LastChanged values
+// If the update fails, these values and the file modification time are left as is,
+// so a failing filter doesn't look freshly updated, even after restart.
 func (f *Filtering) update(filter *filter) (bool, error) {
 	b, err := f.updateIntl(filter)
+	if err != nil {
+		return false, err
+	}
+
 	filter.LastUpdated = time.Now()
-	if !b {
+	if b {
+		filter.LastChanged = filter.LastUpdated
+	} else {
 		e := os.Chtimes(filter.Path(), filter.LastUpdated, filter.LastUpdated)
 		if e != nil {
 			log.Error("os.Chtimes(): %v", e)
 		}
 	}
-	return b, err
+	return b, nil
 }
 
 // nolint(gocyclo)
@@ -508,7 +734,7 @@ func (f *Filtering) updateIntl(filter *filter) (bool, error) {
 
 	tmpFile, err := ioutil.TempFile(filepath.Join(Context.getDataDir(), filterDir), "")
 	if err != nil {
-		return false, err
+		return false, fmt.Errorf("couldn't create temporary file in filters directory: %w", err)
 	}
 	defer func() {
 		if tmpFile != nil {
@@ -518,11 +744,28 @@ func (f *Filtering) updateIntl(filter *filter) (bool, error) {
 	}()
 
 	var reader io.Reader
+	redirectURL := "" // the final URL if the request was redirected
 	if filepath.IsAbs(filter.URL) {
-		f, err := os.Open(filter.URL)
+		path, err := filepath.EvalSymlinks(filter.URL)
+		if err != nil {
+			return false, fmt.Errorf("resolve file path: %s", err)
+		}
+
+		// Opening a FIFO in blocking mode may block forever.
+		// Check the type of the opened file rather than the path, which may be replaced after the check.
+		f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
 		if err != nil {
 			return false, fmt.Errorf("open file: %s", err)
 		}
+		st, err := f.Stat()
+		if err != nil {
+			_ = f.Close()
+			return false, fmt.Errorf("stat file: %s", err)
+		}
+		if !st.Mode().IsRegular() {
+			_ = f.Close()
+			return false, fmt.Errorf("%s is not a regular file", path)
+		}
 		defer f.Close()
 		reader = f
 	} else {
@@ -539,9 +782,18 @@ func (f *Filtering) updateIntl(filter *filter) (bool, error) {
 			log.Printf("Got status code %d from URL %s, skipping", resp.StatusCode, filter.URL)
 			return false, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
 		}
+		if resp.Request != nil && resp.Request.Response != nil {
+			// Request.Response is set only for the requests made because of a redirect
+			redirectURL = resp.Request.URL.String()
+		}
 		reader = resp.Body
 	}
 
+	reader, gzipped, err := decodeUnmarkedGzip(reader, maxUnmarkedGzipSize)
+	if err != nil {
+		return false, err
+	}
+
 	htmlTest := true
 	firstChunk := make([]byte, 4*1024)
 	firstChunkLen := 0
@@ -562,11 +814,18 @@ func (f *Filtering) updateIntl(filter *filter) (bool, error) {
 					return false, fmt.Errorf("data contains non-printable characters")
 				}
 
-				s := strings.ToLower(string(firstChunk))
-				if strings.Index(s, "<html") >= 0 ||
-					strings.Index(s, "<!doctype") >= 0 {
+				if filter.Trusted {
+					log.Debug("Filter #%d is trusted, not checking whether it's an HTML page", filter.ID)
+				} else if isHTML(firstChunk[:firstChunkLen]) {
+					if len(redirectURL) != 0 {
+						return false, fmt.Errorf("download redirected to an HTML page (authentication required?): %s", redirectURL)
+					}
 					return false, fmt.Errorf("data is HTML, not plain text")
 				}
+				if gzipped {
+					log.Info("Filter #%d at URL %s is gzip-compressed without Content-Encoding header, decompressed it",
+						filter.ID, filter.URL)
+				}
 
 				htmlTest = false
 				firstChunk = nil
@@ -575,7 +834,7 @@ func (f *Filtering) updateIntl(filter *filter) (bool, error) {
 
 		_, err2 := tmpFile.Write(buf[:n])
 		if err2 != nil {
-			return false, err2
+			return false, fmt.Errorf("couldn't write filter data to %s: %w", tmpFile.Name(), err2)
 		}
 
 		if err == io.EOF {
@@ -589,20 +848,22 @@ func (f *Filtering) updateIntl(filter *filter) (bool, error) {
 
 	// Extract filter name and count number of rules
 	_, _ = tmpFile.Seek(0, io.SeekStart)
-	rulesCount, checksum, filterName := f.parseFilterContents(tmpFile)
+	info, err := f.parseFilterContents(tmpFile)
+	if err != nil {
+		return false, fmt.Errorf("couldn't read filter data from %s: %s", tmpFile.Name(), err)
+	}
 	// Check if the filter has been really changed
-	if filter.checksum == checksum {
+	if filter.checksum == info.checksum {
 		log.Tracef("Filter #%d at URL %s hasn't changed, not updating it", filter.ID, filter.URL)
 		return false, nil
 	}
 
-	log.Printf("Filter %d has been updated: %d bytes, %d rules",
-		filter.ID, total, rulesCount)
+	log.Printf("Filter %d has been updated: %d bytes, %d rules (%d allowlist rules)",
+		filter.ID, total, info.rulesCount, info.allowRulesCount)
 	if len(filter.Name) == 0 {
-		filter.Name = filterName
+		filter.Name = info.name
 	}
-	filter.RulesCount = rulesCount
-	filter.checksum = checksum
+	filter.setContentsInfo(info)
 	filterFilePath := filter.Path()
 	log.Printf("Saving filter %d contents to: %s", filter.ID, filterFilePath)
 
@@ -610,7 +871,7 @@ func (f *Filtering) updateIntl(filter *filter) (bool, error) {
 	_ = tmpFile.Close()
 	err = os.Rename(tmpFile.Name(), filterFilePath)
 	if err != nil {
-		return false, err
+		return false, fmt.Errorf("couldn't save filter data to %s: %w", filterFilePath, err)
 	}
 	tmpFile = nil
 
@@ -636,10 +897,13 @@ func (f *Filtering) load(filter *filter) error {
 
 	log.Tracef("File %s, id %d, length %d",
 		filterFilePath, filter.ID, st.Size())
-	rulesCount, checksum, _ := f.parseFilterContents(file)
+	info, err := f.parseFilterContents(file)
+	if err != nil {
+		// Keep the filter unloaded, so it's updated on the next check
+		return fmt.Errorf("parsing %s: %s", filterFilePath, err)
+	}
 
-	filter.RulesCount = rulesCount
-	filter.checksum = checksum
+	filter.setContentsInfo(info)
 	filter.LastUpdated = filter.LastTimeUpdated()
 
 	return nil
@@ -647,8 +911,30 @@ func (f *Filtering) load(filter *filter) error {
 
 // Clear filter rules
 func (filter *filter) unload() {
-	filter.RulesCount = 0
-	filter.checksum = 0
+	filter.setContentsInfo(filterContentsInfo{})
+}
+
+// Set the information about the filter data (except the name)
+func (filter *filter) setContentsInfo(info filterContentsInfo) {
+	filter.RulesCount = info.rulesCount
+	filter.AllowRulesCount = info.allowRulesCount
+	filter.CommentsCount = info.commentsCount
+	filter.LinesCount = info.linesCount
+	filter.SyntaxHeader = info.syntaxHeader
+	filter.checksum = info.checksum
+}
+
+// Get the information about the filter data
+func (filter *filter) contentsInfo() filterContentsInfo {
+	return filterContentsInfo{
+		rulesCount:      filter.RulesCount,
+		allowRulesCount: filter.AllowRulesCount,
+		commentsCount:   filter.CommentsCount,
+		linesCount:      filter.LinesCount,
+		syntaxHeader:    filter.SyntaxHeader,
+		checksum:        filter.checksum,
+		name:            filter.Name,
+	}
 }
 
 // Path to the filter contents
@@ -1,10 +1,23 @@
 package home
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -20,6 +33,23 @@ func testStartFilterListener() net.Listener {
 `
 		_, _ = w.Write([]byte(content))
 	})
+	http.HandleFunc("/filters/2.gz", func(w http.ResponseWriter, r *http.Request) {
+		// gzip data without Content-Encoding header
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		_, _ = zw.Write([]byte("||example.org^\n||example.com^\n"))
+		_ = zw.Close()
+		_, _ = w.Write(buf.Bytes())
+	})
+	http.HandleFunc("/filters/3.txt", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+	})
+	http.HandleFunc("/filters/ü.html", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<!DOCTYPE html><html><body>Not a list</body></html>"))
+	})
+	http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<!DOCTYPE html><html><body>Sign in</body></html>"))
+	})
 
 	listener, err := net.Listen("tcp", ":0")
 	if err != nil {
@@ -41,7 +71,7 @@ func TestFilters(t *testing.T) {
 	Context.client = &http.Client{
 		Timeout: 5 * time.Second,
 	}
-	Context.filters.Init()
+	assert.Nil(t, Context.filters.Init())
 
 	f := filter{
 		URL: fmt.Sprintf("http://127.0.0.1:%d/filters/1.txt", l.Addr().(*net.TCPAddr).Port),
@@ -62,4 +92,476 @@ func TestFilters(t *testing.T) {
 
 	f.unload()
 	_ = os.Remove(f.Path())
+
+	// gzip data without Content-Encoding header
+	f = filter{
+		URL: fmt.Sprintf("http://127.0.0.1:%d/filters/2.gz", l.Addr().(*net.TCPAddr).Port),
+	}
+	f.ID = 2
+	ok, err = Context.filters.update(&f)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, f.RulesCount)
+	_ = os.Remove(f.Path())
+
+	// redirect to an HTML page
+	f = filter{
+		URL: fmt.Sprintf("http://127.0.0.1:%d/filters/3.txt", l.Addr().(*net.TCPAddr).Port),
+	}
+	f.ID = 3
+	ok, err = Context.filters.update(&f)
+	assert.False(t, ok)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "redirected to an HTML page"))
+
+	// HTML without a redirect: the URL changes when it's encoded, but it's not a redirect
+	f = filter{
+		URL: fmt.Sprintf("http://127.0.0.1:%d/filters/ü.html", l.Addr().(*net.TCPAddr).Port),
+	}
+	f.ID = 4
+	ok, err = Context.filters.update(&f)
+	assert.False(t, ok)
+	assert.NotNil(t, err)
+	assert.Equal(t, "data is HTML, not plain text", err.Error())
+}
+
+func TestIsHTML(t *testing.T) {
+	assert.True(t, isHTML([]byte("<!DOCTYPE html>\n<html></html>")))
+	assert.True(t, isHTML([]byte("\n\n  <html lang=\"en\">")))
+	assert.True(t, isHTML([]byte("\xef\xbb\xbf<?xml version=\"1.0\"?>")))
+	assert.True(t, isHTML([]byte("  <head><title>Just a moment...</title></head>")))
+	assert.True(t, isHTML([]byte("<title>Attention Required!</title>")))
+	assert.True(t, isHTML([]byte("\n<noscript>...</noscript>\n<title>Just a moment...</title>")))
+	assert.True(t, isHTML([]byte("<!-- page -->\n<div class=\"cf-browser-verification\">")))
+	assert.True(t, isHTML([]byte("<!-- page -->\n<script>(function(){window._cf_chl_opt={}})()</script>")))
+
+	assert.False(t, isHTML([]byte("||example.org^\n||example.com^\n")))
+	assert.False(t, isHTML([]byte("\xef\xbb\xbf! Title: list\n||example.org^\n")))
+	assert.False(t, isHTML([]byte("! rules for sites that use <head> tricks\n||example.org^\n")))
+	assert.False(t, isHTML([]byte("! Cloudflare challenge pages\n@@||challenges.cloudflare.com^\n")))
+	assert.False(t, isHTML([]byte("! Cloudflare\n##.cf-browser-verification\nexample.org#%#window._cf_chl_opt=undefined;\n")))
+	assert.False(t, isHTML([]byte("##.cf-browser-verification\n")))
+}
+
+func TestFiltersUpdateFirstDelay(t *testing.T) {
+	filters := config.Filters
+	whiteFilters := config.WhitelistFilters
+	hours := config.DNS.FiltersUpdateIntervalHours
+	initial := config.DNS.FiltersUpdateInitialDelay
+	sleep := filtersUpdateSleep
+	defer func() {
+		config.Filters = filters
+		config.WhitelistFilters = whiteFilters
+		config.DNS.FiltersUpdateIntervalHours = hours
+		config.DNS.FiltersUpdateInitialDelay = initial
+		filtersUpdateSleep = sleep
+	}()
+	config.Filters = nil
+	config.WhitelistFilters = nil
+	config.DNS.FiltersUpdateIntervalHours = 24
+	config.DNS.FiltersUpdateInitialDelay = 7
+
+	f := Filtering{}
+	sleeps := make(chan time.Duration, 2)
+	done := make(chan struct{})
+	filtersUpdateSleep = func(d time.Duration) {
+		if len(sleeps) == cap(sleeps)-1 {
+			sleeps <- d
+			close(done)
+			runtime.Goexit()
+		}
+		// the update hasn't started yet
+		assert.Equal(t, uint32(0), atomic.LoadUint32(&f.refreshStatus))
+		sleeps <- d
+	}
+
+	// the update blocks here until we let it continue
+	f.refreshLock.Lock()
+	go f.periodicallyRefreshFilters()
+	select {
+	case d := <-sleeps:
+		assert.Equal(t, 7*time.Second, d)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first update hasn't been delayed")
+	}
+	for atomic.LoadUint32(&f.refreshStatus) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	f.refreshLock.Unlock()
+	<-done
+}
+
+func TestFiltersUpdateDelays(t *testing.T) {
+	config.DNS.FiltersUpdateInitialDelay = 0
+	config.DNS.FiltersUpdateMaxDelay = 0
+	initial, maxDelay := filtersUpdateDelays()
+	assert.Equal(t, defaultFiltersUpdateInitialDelay, initial)
+	assert.Equal(t, defaultFiltersUpdateMaxDelay, maxDelay)
+
+	config.DNS.FiltersUpdateInitialDelay = 60
+	config.DNS.FiltersUpdateMaxDelay = 600
+	initial, maxDelay = filtersUpdateDelays()
+	assert.Equal(t, 60, initial)
+	assert.Equal(t, 600, maxDelay)
+
+	// initial delay is clamped
+	config.DNS.FiltersUpdateInitialDelay = 1000
+	initial, maxDelay = filtersUpdateDelays()
+	assert.Equal(t, 600, initial)
+	assert.Equal(t, 600, maxDelay)
+
+	config.DNS.FiltersUpdateInitialDelay = defaultFiltersUpdateInitialDelay
+	config.DNS.FiltersUpdateMaxDelay = defaultFiltersUpdateMaxDelay
+}
+
+type errReader struct{}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read error")
+}
+
+func TestParseFilterContentsReadError(t *testing.T) {
+	f := Filtering{}
+	r := io.MultiReader(strings.NewReader("||example.org^\n||example.com^\n"), &errReader{})
+	info, err := f.parseFilterContents(r)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, info.rulesCount)
+
+	info, err = f.parseFilterContents(strings.NewReader("||example.org^\n||example.com^"))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, info.rulesCount)
+	assert.Equal(t, "", info.syntaxHeader)
+}
+
+func TestFiltersLocalFile(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	assert.Nil(t, Context.filters.Init())
+
+	absDir, _ := filepath.Abs(dir)
+	listPath := filepath.Join(absDir, "list.txt")
+	_ = ioutil.WriteFile(listPath, []byte("||example.org^\n||example.com^\n"), 0644)
+	linkPath := filepath.Join(absDir, "link.txt")
+	assert.Nil(t, os.Symlink(listPath, linkPath))
+
+	// symlink to a regular file
+	f := filter{URL: linkPath}
+	f.ID = 1
+	ok, err := Context.filters.update(&f)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, f.RulesCount)
+	assert.Equal(t, 2, f.LinesCount)
+
+	// the same values are loaded after restart
+	f.unload()
+	assert.Nil(t, Context.filters.load(&f))
+	assert.Equal(t, 2, f.RulesCount)
+	assert.Equal(t, 0, f.CommentsCount)
+	assert.Equal(t, 2, f.LinesCount)
+
+	// directory
+	f = filter{URL: absDir}
+	f.ID = 2
+	ok, err = Context.filters.update(&f)
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+
+	// file doesn't exist
+	f = filter{URL: filepath.Join(absDir, "none.txt")}
+	f.ID = 3
+	ok, err = Context.filters.update(&f)
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+}
+
+func TestFiltersTrusted(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	assert.Nil(t, Context.filters.Init())
+
+	absDir, _ := filepath.Abs(dir)
+	listPath := filepath.Join(absDir, "list.txt")
+	_ = ioutil.WriteFile(listPath, []byte("<title>rules</title>\n||example.org^\n"), 0644)
+	binPath := filepath.Join(absDir, "list.bin")
+	_ = ioutil.WriteFile(binPath, []byte("||example.org^\n\x00\x01"), 0644)
+
+	// the data looks like an HTML page
+	f := filter{URL: listPath}
+	f.ID = 1
+	ok, err := Context.filters.update(&f)
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+
+	// the HTML check is skipped for a trusted filter
+	f = filter{URL: listPath, Trusted: true}
+	f.ID = 1
+	ok, err = Context.filters.update(&f)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, f.RulesCount)
+
+	// but non-printable data is still rejected
+	f = filter{URL: binPath, Trusted: true}
+	f.ID = 2
+	ok, err = Context.filters.update(&f)
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+}
+
+func TestParseFilterContents(t *testing.T) {
+	f := Filtering{}
+	f.filterTitleRegexp = regexp.MustCompile(`^! Title: +(.*)$`)
+
+	longRule := "||" + strings.Repeat("a", 10*1024) + ".com^"
+	data := "[Adblock Plus 2.0]\n" +
+		"! Title: First\r\n" +
+		"! Title: Second\n" +
+		"# comment\n" +
+		"\n" +
+		"  ||example.org^  \n" +
+		longRule + "\n" +
+		"@@||example.net^\n" +
+		"[AdGuard]\n" +
+		"[$path=/page]example.org##.ad\n" +
+		"0.0.0.0 example.com"
+	info, err := f.parseFilterContents(strings.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, info.rulesCount)
+	assert.Equal(t, 1, info.allowRulesCount)
+	assert.Equal(t, 3, info.commentsCount)
+	assert.Equal(t, 11, info.linesCount)
+	assert.Equal(t, "[Adblock Plus 2.0]", info.syntaxHeader)
+	assert.Equal(t, crc32.ChecksumIEEE([]byte(data)), info.checksum)
+	assert.Equal(t, "First", info.name)
+}
+
+func BenchmarkParseFilterContents(b *testing.B) {
+	f := Filtering{}
+	f.filterTitleRegexp = regexp.MustCompile(`^! Title: +(.*)$`)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("! Title: Benchmark\n")
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(buf, "||example%d.org^\n", i)
+	}
+	data := buf.Bytes()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = f.parseFilterContents(bytes.NewReader(data))
+	}
+}
+
+func TestAssignUniqueFilterID(t *testing.T) {
+	filters := config.Filters
+	whiteFilters := config.WhitelistFilters
+	savedNextFilterID := nextFilterID
+	defer func() {
+		config.Filters = filters
+		config.WhitelistFilters = whiteFilters
+		nextFilterID = savedNextFilterID
+	}()
+
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	config.Filters = nil
+	config.WhitelistFilters = nil
+	assert.Nil(t, Context.filters.Init())
+
+	// the ID equal to the next one is taken
+	taken := []filter{{}}
+	taken[0].ID = nextFilterID
+	updateUniqueFilterID(taken)
+	assert.Equal(t, taken[0].ID+1, nextFilterID)
+
+	// the clock went backwards: the files for the next IDs exist
+	id := nextFilterID
+	for i := int64(0); i < 2; i++ {
+		f := filter{}
+		f.ID = id + i
+		assert.Nil(t, ioutil.WriteFile(f.Path(), []byte("||example.org^\n"), 0644))
+	}
+	assert.Equal(t, id+2, assignUniqueFilterID())
+	assert.Equal(t, id+3, assignUniqueFilterID())
+
+	// os.Stat() fails with an error other than "not exist"
+	filtersDir := filepath.Join(Context.getDataDir(), filterDir)
+	assert.Nil(t, os.RemoveAll(filtersDir))
+	assert.Nil(t, ioutil.WriteFile(filtersDir, nil, 0644))
+	assert.Equal(t, id+4, assignUniqueFilterID())
+}
+
+func TestDecodeUnmarkedGzipLimit(t *testing.T) {
+	data := []byte(strings.Repeat("||example.org^\n", 100))
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, _ = zw.Write(data)
+	_ = zw.Close()
+	compressed := buf.Bytes()
+
+	// exactly at the limit
+	r, gzipped, err := decodeUnmarkedGzip(bytes.NewReader(compressed), int64(len(data)))
+	assert.Nil(t, err)
+	assert.True(t, gzipped)
+	out, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, out)
+
+	// over the limit
+	r, _, err = decodeUnmarkedGzip(bytes.NewReader(compressed), int64(len(data)-1))
+	assert.Nil(t, err)
+	_, err = ioutil.ReadAll(r)
+	assert.NotNil(t, err)
+
+	// not gzip: no limit
+	r, gzipped, err = decodeUnmarkedGzip(bytes.NewReader(data), 1)
+	assert.Nil(t, err)
+	assert.False(t, gzipped)
+	out, err = ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, out)
+}
+
+func TestFiltersStorageErrors(t *testing.T) {
+	assert.True(t, isStorageError(fmt.Errorf("write: %w", &os.PathError{Op: "write", Path: "1.txt", Err: syscall.ENOSPC})))
+	assert.True(t, isStorageError(fmt.Errorf("create: %w", &os.PathError{Op: "open", Path: "1.txt", Err: syscall.EACCES})))
+	assert.True(t, isStorageError(fmt.Errorf("rename: %w", &os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EROFS})))
+	assert.False(t, isStorageError(fmt.Errorf("got status code != 200: %d", 404)))
+
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+
+	// the filters directory can't be created
+	assert.Nil(t, os.MkdirAll(Context.getDataDir(), 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(Context.getDataDir(), filterDir), nil, 0644))
+	err := Context.filters.Init()
+	assert.True(t, errors.Is(err, syscall.ENOTDIR))
+
+	// the temporary file can't be created
+	absDir, _ := filepath.Abs(dir)
+	listPath := filepath.Join(absDir, "list.txt")
+	assert.Nil(t, ioutil.WriteFile(listPath, []byte("||example.org^\n"), 0644))
+	f := filter{URL: listPath}
+	f.ID = 1
+	ok, err := Context.filters.update(&f)
+	assert.False(t, ok)
+	assert.True(t, errors.Is(err, syscall.ENOTDIR))
+}
+
+func TestFilterWithSameData(t *testing.T) {
+	filters := config.Filters
+	defer func() { config.Filters = filters }()
+
+	config.Filters = []filter{
+		{Enabled: true, URL: "https://example.org/1.txt", checksum: 1},
+		{Enabled: false, URL: "https://example.org/2.txt", checksum: 2},
+	}
+	f, ok := filterWithSameData(1)
+	assert.True(t, ok)
+	assert.Equal(t, "https://example.org/1.txt", f.URL)
+
+	// disabled filters are not checked
+	_, ok = filterWithSameData(2)
+	assert.False(t, ok)
+
+	_, ok = filterWithSameData(3)
+	assert.False(t, ok)
+}
+
+func TestFiltersUpdateTimes(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	assert.Nil(t, Context.filters.Init())
+
+	absDir, _ := filepath.Abs(dir)
+	listPath := filepath.Join(absDir, "list.txt")
+	assert.Nil(t, ioutil.WriteFile(listPath, []byte("||example.org^\n"), 0644))
+
+	// the data has changed
+	f := filter{URL: listPath}
+	f.ID = 1
+	ok, err := Context.filters.update(&f)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.False(t, f.LastUpdated.IsZero())
+	assert.Equal(t, f.LastUpdated, f.LastChanged)
+	changed := f.LastChanged
+
+	// the data hasn't changed: only the last successful update time is set
+	time.Sleep(10 * time.Millisecond)
+	ok, err = Context.filters.update(&f)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.True(t, f.LastUpdated.After(changed))
+	assert.Equal(t, changed, f.LastChanged)
+
+	// the update fails: nothing is changed, including the file modification time
+	st, err := os.Stat(f.Path())
+	assert.Nil(t, err)
+	lastUpdated := f.LastUpdated
+	assert.Nil(t, os.Remove(listPath))
+	time.Sleep(10 * time.Millisecond)
+	ok, err = Context.filters.update(&f)
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, lastUpdated, f.LastUpdated)
+	assert.Equal(t, changed, f.LastChanged)
+	st2, err := os.Stat(f.Path())
+	assert.Nil(t, err)
+	assert.Equal(t, st.ModTime(), st2.ModTime())
+}
+
+func TestFiltersRejectDuplicates(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	assert.Nil(t, Context.filters.Init())
+
+	filters := config.Filters
+	nextID := nextFilterID
+	defer func() {
+		config.Filters = filters
+		nextFilterID = nextID
+		config.DNS.FiltersRejectDuplicates = false
+	}()
+
+	absDir, _ := filepath.Abs(dir)
+	path1 := filepath.Join(absDir, "list1.txt")
+	path2 := filepath.Join(absDir, "list2.txt")
+	data := []byte("! Title: List\n||example.org^\n")
+	assert.Nil(t, ioutil.WriteFile(path1, data, 0644))
+	assert.Nil(t, ioutil.WriteFile(path2, data, 0644))
+
+	existing := filter{Enabled: true, URL: path1, Name: "List"}
+	existing.ID = 1
+	_, err := Context.filters.update(&existing)
+	assert.Nil(t, err)
+	config.Filters = []filter{existing}
+	nextFilterID = 2
+
+	config.DNS.FiltersRejectDuplicates = true
+	body := fmt.Sprintf(`{"name":"Mirror","url":%q}`, path2)
+	r := httptest.NewRequest("POST", "/control/filtering/add_url", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	Context.filters.handleFilteringAddURL(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), path1))
+	assert.Equal(t, 1, len(config.Filters))
+
+	// the downloaded data isn't left behind
+	_, err = os.Stat(filepath.Join(Context.getDataDir(), filterDir, "2.txt"))
+	assert.True(t, os.IsNotExist(err))
 }
@@ -0,0 +1,38 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package home
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFiltersLocalFIFO(t *testing.T) {
+	dir := prepareTestDir()
+	defer func() { _ = os.RemoveAll(dir) }()
+	Context = homeContext{}
+	Context.workDir = dir
+	assert.Nil(t, Context.filters.Init())
+
+	absDir, _ := filepath.Abs(dir)
+	fifoPath := filepath.Join(absDir, "list.fifo")
+	assert.Nil(t, syscall.Mkfifo(fifoPath, 0644))
+
+	// must not block on open
+	f := filter{URL: fifoPath}
+	f.ID = 1
+	ok, err := Context.filters.update(&f)
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+
+	// character device
+	f = filter{URL: "/dev/null"}
+	f.ID = 2
+	ok, err = Context.filters.update(&f)
+	assert.NotNil(t, err)
+	assert.False(t, ok)
+}